@@ -2,15 +2,20 @@ package qshell
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"github.com/astaxie/beego/logs"
+	"github.com/cheggaaa/pb/v3"
+	"github.com/mattn/go-isatty"
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/opt"
 	"io"
+	"math/rand"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"qiniu/api.v6/auth/digest"
 	"qiniu/api.v6/conf"
@@ -18,6 +23,7 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -35,6 +41,7 @@ import (
 const (
 	MIN_DOWNLOAD_THREAD_COUNT = 1
 	MAX_DOWNLOAD_THREAD_COUNT = 2000
+	STATUS_INTERRUPTED        = 130
 )
 
 type DownloadConfig struct {
@@ -43,7 +50,23 @@ type DownloadConfig struct {
 	Prefix   string `json:"prefix,omitempty"`
 	Suffixes string `json:"suffixes,omitempty"`
 	CdnDomain string `json:"cdn_domain,omitempty"`
-	DownProxy string `json:"proxy,omitempty"`
+	//additional CDN domains to fail over to, tried in order after CdnDomain
+	CdnDomains []string `json:"cdn_domains,omitempty"`
+	DownProxy  string   `json:"proxy,omitempty"`
+	//verify the downloaded file against the etag reported by `ListBucket`
+	VerifyHash bool `json:"verify_hash,omitempty"`
+	//fall back to line-based progress output, for non-TTY / CI use
+	NoProgress bool `json:"no_progress,omitempty"`
+	//retry settings, used on network errors, 5xx responses and truncated reads
+	MaxRetries     int           `json:"max_retries,omitempty"`
+	RetryBaseDelay time.Duration `json:"retry_base_delay,omitempty"`
+	//split objects larger than ChunkSize into ChunksPerFile concurrent
+	//byte-range requests; ignored when the server doesn't advertise
+	//`Accept-Ranges: bytes`
+	ChunksPerFile int   `json:"chunks_per_file,omitempty"`
+	ChunkSize     int64 `json:"chunk_size,omitempty"`
+	//lifecycle event notifications
+	Webhook WebhookConfig `json:"webhook,omitempty"`
 	//log settings
 	LogLevel  string `json:"log_level,omitempty"`
 	LogFile   string `json:"log_file,omitempty"`
@@ -51,21 +74,63 @@ type DownloadConfig struct {
 	LogStdout bool   `json:"log_stdout,omitempty"`
 }
 
-var downloadTasks chan func()
+var downloadTasks chan func(bar *pb.ProgressBar)
 var initDownOnce sync.Once
 
-func doDownload(tasks chan func()) {
+//aggregateBar tracks total bytes copied across all worker bars
+var aggregateBar *pb.ProgressBar
+var aggregateTotalBytes int64
+var progressPool *pb.Pool
+
+func doDownload(tasks chan func(bar *pb.ProgressBar), bar *pb.ProgressBar) {
 	for {
 		task := <-tasks
-		task()
+		task(bar)
+	}
+}
+
+//progressSupported reports whether per-file progress bars can be rendered,
+//i.e. the user did not opt out and stderr is an interactive terminal
+func progressSupported(noProgress bool) bool {
+	if noProgress {
+		return false
 	}
+	fd := os.Stderr.Fd()
+	return isatty.IsTerminal(fd) || isatty.IsCygwinTerminal(fd)
 }
 
 func QiniuDownload(threadCount int, downConfig *DownloadConfig) {
 	timeStart := time.Now()
+
+	//cancel all in-flight downloads on Ctrl-C / SIGTERM, a second signal
+	//within 3 seconds forces an immediate exit
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigCh := make(chan os.Signal, 2)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigCh)
+	go func() {
+		if _, ok := <-sigCh; !ok {
+			return
+		}
+		logs.Warning("Received interrupt signal, finishing in-flight downloads and saving resume state ...")
+		cancel()
+		select {
+		case <-sigCh:
+			logs.Error("Received second interrupt signal, exiting immediately")
+			os.Exit(STATUS_INTERRUPTED)
+		case <-time.After(3 * time.Second):
+		}
+	}()
+
 	//create job id
 	jobId := Md5Hex(fmt.Sprintf("%s:%s", downConfig.DestDir, downConfig.Bucket))
 
+	//closed explicitly (not via defer, which os.Exit skips) on every exit
+	//path reachable after the first webhook.notify call, so a queued event
+	//is never silently dropped
+	webhook := newWebhookNotifier(downConfig.Webhook)
+
 	//local storage path
 	storePath := filepath.Join(QShellRootPath, ".qshell", "qdownload", jobId)
 	if mkdirErr := os.MkdirAll(storePath, 0775); mkdirErr != nil {
@@ -149,6 +214,26 @@ func QiniuDownload(threadCount int, downConfig *DownloadConfig) {
 
 	downProxy := downConfig.DownProxy
 
+	//CDN domains to try, in order, on retry; falls back to the bucket's
+	//default io host when none are configured
+	var cdnCandidates []string
+	if downConfig.CdnDomain != "" {
+		cdnCandidates = append(cdnCandidates, downConfig.CdnDomain)
+	}
+	cdnCandidates = append(cdnCandidates, downConfig.CdnDomains...)
+	if len(cdnCandidates) == 0 {
+		cdnCandidates = []string{ioProxyAddress}
+	}
+
+	maxRetries := downConfig.MaxRetries
+	if maxRetries <= 0 {
+		maxRetries = 3
+	}
+	retryBaseDelay := downConfig.RetryBaseDelay
+	if retryBaseDelay <= 0 {
+		retryBaseDelay = 500 * time.Millisecond
+	}
+
 	jobListFileName := filepath.Join(storePath, fmt.Sprintf("%s.list", jobId))
 	resumeFile := filepath.Join(storePath, fmt.Sprintf("%s.ldb", jobId))
 	resumeLevelDb, openErr := leveldb.OpenFile(resumeFile, nil)
@@ -174,10 +259,38 @@ func QiniuDownload(threadCount int, downConfig *DownloadConfig) {
 	//init wait group
 	downWaitGroup := sync.WaitGroup{}
 
+	progressEnabled := progressSupported(downConfig.NoProgress)
+
 	initDownOnce.Do(func() {
-		downloadTasks = make(chan func(), threadCount)
+		downloadTasks = make(chan func(bar *pb.ProgressBar), threadCount)
+		workerBars := make([]*pb.ProgressBar, threadCount)
 		for i := 0; i < threadCount; i++ {
-			go doDownload(downloadTasks)
+			var bar *pb.ProgressBar
+			if progressEnabled {
+				bar = pb.New64(0)
+				bar.Set(pb.Bytes, true)
+				workerBars[i] = bar
+			}
+			go doDownload(downloadTasks, bar)
+		}
+
+		if progressEnabled {
+			aggregateBar = pb.New64(0).Set(pb.Bytes, true).SetTemplateString(
+				`Total: {{counters . }} {{speed . }} {{percent . }} {{etime . }}`)
+			poolBars := append(workerBars, aggregateBar)
+			pool, poolErr := pb.NewPool(poolBars...)
+			if poolErr != nil {
+				logs.Error("Start progress pool error", poolErr)
+				progressEnabled = false
+				return
+			}
+			pool.Output = os.Stderr
+			if startErr := pool.Start(); startErr != nil {
+				logs.Error("Start progress pool error", startErr)
+				progressEnabled = false
+				return
+			}
+			progressPool = pool
 		}
 	})
 
@@ -189,13 +302,22 @@ func QiniuDownload(threadCount int, downConfig *DownloadConfig) {
 	var successFileCount int64
 	var failureFileCount int64
 	var skipBySuffixes int64
+	var hashMismatchCount int64
 
 	totalFileCount = GetFileLineCount(jobListFileName)
 
+	webhook.notify("job_started", map[string]interface{}{
+		"jobId":          jobId,
+		"bucket":         downConfig.Bucket,
+		"prefix":         downConfig.Prefix,
+		"totalFileCount": totalFileCount,
+	})
+
 	//open prepared file list to download files
 	listFp, openErr := os.Open(jobListFileName)
 	if openErr != nil {
 		logs.Error("Open list file error", openErr)
+		webhook.close()
 		os.Exit(STATUS_ERROR)
 	}
 	defer listFp.Close()
@@ -243,25 +365,22 @@ func QiniuDownload(threadCount int, downConfig *DownloadConfig) {
 				continue
 			}
 
+			fileEtag := items[2]
+
 			fileMtime, pErr := strconv.ParseInt(items[3], 10, 64)
 			if pErr != nil {
 				logs.Error("Invalid list line", line)
 				continue
 			}
 
-			var fileUrl string
-			if downConfig.CdnDomain == "" { // if cdn_domain is not provided, use default domain
-				fileUrl = makePrivateDownloadLink(&mac, domainOfBucket, ioProxyAddress, fileKey)
-			} else { // if cdn_domain is provided, use it
-				fileUrl = makePrivateDownloadLink(&mac, domainOfBucket, downConfig.CdnDomain, fileKey)
-			}
-
 			//progress
-			if totalFileCount != 0 {
-				fmt.Printf("Downloading %s [%d/%d, %.1f%%] ...\n", fileKey, currentFileCount, totalFileCount,
-					float32(currentFileCount)*100/float32(totalFileCount))
-			} else {
-				fmt.Printf("Downloading %s ...\n", fileKey)
+			if !progressEnabled {
+				if totalFileCount != 0 {
+					fmt.Printf("Downloading %s [%d/%d, %.1f%%] ...\n", fileKey, currentFileCount, totalFileCount,
+						float32(currentFileCount)*100/float32(totalFileCount))
+				} else {
+					fmt.Printf("Downloading %s ...\n", fileKey)
+				}
 			}
 			//check whether log file exists
 			localFilePath := filepath.Join(downConfig.DestDir, fileKey)
@@ -317,6 +436,20 @@ func QiniuDownload(threadCount int, downConfig *DownloadConfig) {
 							//tmp file exists, file not changed, use range to download
 							if localTmpFileInfo.Size() < fileSize {
 								fromBytes = localTmpFileInfo.Size()
+								//prefer the exact flushed offset recorded by a
+								//previous interrupted download, if any
+								if offVal, offErr := resumeLevelDb.Get([]byte(offsetResumeKey(localAbsFilePath)), nil); offErr == nil {
+									if off, convErr := strconv.ParseInt(string(offVal), 10, 64); convErr == nil && off <= localTmpFileInfo.Size() {
+										fromBytes = off
+									}
+								}
+							} else if isChunkedDownload(fileSize, downConfig.ChunksPerFile, downConfig.ChunkSize) &&
+								!chunkedDownloadComplete(resumeLevelDb, localAbsFilePath, fileSize, downConfig.ChunkSize) {
+								//downloadFileChunked preallocates the .tmp file to fileSize
+								//before any chunk is written, so size alone doesn't mean this
+								//chunked download finished; fall through and let it resume
+								//whichever chunks are still missing
+								logs.Informational("Local tmp file `%s` matches remote size but chunk resume state is incomplete, resuming chunked download", localFilePathTmp)
 							} else {
 								//rename it
 								renameErr := os.Rename(localFilePathTmp, localFilePath)
@@ -345,21 +478,40 @@ func QiniuDownload(threadCount int, downConfig *DownloadConfig) {
 			rVal := fmt.Sprintf("%d|%d", fileMtime, fileSize)
 			resumeLevelDb.Put([]byte(rKey), []byte(rVal), &ldbWOpt)
 
+			if progressEnabled && aggregateBar != nil {
+				atomic.AddInt64(&aggregateTotalBytes, fileSize-fromBytes)
+				aggregateBar.SetTotal(atomic.LoadInt64(&aggregateTotalBytes))
+			}
+
 			//download new
 			downWaitGroup.Add(1)
-			downloadTasks <- func() {
+			downloadTasks <- func(bar *pb.ProgressBar) {
 				defer downWaitGroup.Done()
 
-				var downErr error
-				if downConfig.CdnDomain == "" { // if cdn_domain is not provided, use default domain
-					downErr = downloadFile(downConfig.DestDir, fileKey, fileUrl, domainOfBucket, downProxy, fileSize, fromBytes)
-				} else { // if cdn_domain is provided, use it
-					downErr = downloadFile(downConfig.DestDir, fileKey, fileUrl, downConfig.CdnDomain, downProxy, fileSize, fromBytes)
-				}
+				fileDownStart := time.Now()
+				attempts, downErr := downloadFileMaybeChunked(ctx, &mac, downConfig.DestDir, fileKey, domainOfBucket, cdnCandidates, downProxy, fileSize, fromBytes, downConfig.VerifyHash, fileEtag, bar, resumeLevelDb, &ldbWOpt, maxRetries, retryBaseDelay, downConfig.ChunksPerFile, downConfig.ChunkSize)
 
 				if downErr != nil {
 					atomic.AddInt64(&failureFileCount, 1)
+					if downErr == ErrHashMismatch {
+						atomic.AddInt64(&hashMismatchCount, 1)
+						//mismatch means the tmp file was removed, so drop the
+						//resume record written above for it
+						resumeLevelDb.Delete([]byte(rKey), &ldbWOpt)
+					}
+					webhook.notify("file_failed", map[string]interface{}{
+						"fileKey":  fileKey,
+						"error":    downErr.Error(),
+						"attempts": attempts,
+					})
 				} else {
+					webhook.notify("file_downloaded", map[string]interface{}{
+						"fileKey":   fileKey,
+						"size":      fileSize,
+						"hash":      fileEtag,
+						"duration":  time.Since(fileDownStart).Seconds(),
+						"fromBytes": fromBytes,
+					})
 					atomic.AddInt64(&successFileCount, 1)
 					if !downNewLog {
 						atomic.AddInt64(&updateFileCount, 1)
@@ -372,16 +524,38 @@ func QiniuDownload(threadCount int, downConfig *DownloadConfig) {
 	//wait for all tasks done
 	downWaitGroup.Wait()
 
+	if progressPool != nil {
+		progressPool.Stop()
+	}
+
 	logs.Informational("-------Download Result-------")
 	logs.Informational("%10s%10d", "Total:", totalFileCount)
 	logs.Informational("%10s%10d", "Exists:", existsFileCount)
 	logs.Informational("%10s%10d", "Success:", successFileCount)
 	logs.Informational("%10s%10d", "Update:", updateFileCount)
 	logs.Informational("%10s%10d", "Failure:", failureFileCount)
+	logs.Informational("%10s%10d", "HashMismatch:", hashMismatchCount)
 	logs.Informational("%10s%15s", "Duration:", time.Since(timeStart))
 	logs.Informational("-----------------------------")
 	fmt.Println("\nSee download log at path", downConfig.LogFile)
 
+	webhook.notify("job_finished", map[string]interface{}{
+		"jobId":             jobId,
+		"totalFileCount":    totalFileCount,
+		"existsFileCount":   existsFileCount,
+		"successFileCount":  successFileCount,
+		"updateFileCount":   updateFileCount,
+		"failureFileCount":  failureFileCount,
+		"hashMismatchCount": hashMismatchCount,
+		"duration":          time.Since(timeStart).Seconds(),
+	})
+	webhook.close()
+
+	if ctx.Err() != nil {
+		logs.Warning("Download interrupted, resume state saved, rerun the same command to continue")
+		os.Exit(STATUS_INTERRUPTED)
+	}
+
 	if failureFileCount > 0 {
 		os.Exit(STATUS_ERROR)
 	}
@@ -400,49 +574,143 @@ func makePrivateDownloadLink(mac *digest.Mac, domainOfBucket, ioProxyAddress, fi
 	return
 }
 
-//file key -> mtime
-func downloadFile(destDir, fileName, fileUrl, domainsOfBucket,downProxy string, fileSize int64, fromBytes int64) (err error) {
-	startDown := time.Now().Unix()
+//ErrHashMismatch is returned by downloadFile when VerifyHash is enabled and
+//the downloaded content's Qiniu etag does not match the etag from ListBucket
+var ErrHashMismatch = errors.New("downloaded content hash mismatch")
+
+//offsetResumeKey is the leveldb key that tracks exactly how many bytes of
+//localAbsFilePath's .tmp file have actually been flushed to disk, so an
+//interrupted download can be range-resumed from a known-good offset
+func offsetResumeKey(localAbsFilePath string) string {
+	return localAbsFilePath + "#offset"
+}
+
+//newDownloadHttpClient builds an *http.Client honoring downProxy (either
+//empty for a direct connection, or a bare host:port or full URL). When a
+//proxy is used, remoteUrl is fileUrl prefixed with "http://" if it lacks
+//it; without a proxy, remoteUrl is fileUrl unchanged
+func newDownloadHttpClient(downProxy, fileUrl string) (client *http.Client, remoteUrl string, err error) {
+	remoteUrl = fileUrl
+	if downProxy == "" { // 不使用代理
+		client = &http.Client{}
+		return
+	}
+
+	// 使用代理
+	downloadProxy := downProxy
+	if strings.Index(downloadProxy, "http") < 0 {
+		// downloadProxy类似于http://127.0.0.1:8080
+		downloadProxy = fmt.Sprintf("http://%s", downloadProxy)
+	}
+	urlProxy, pErr := url.Parse(downloadProxy)
+	if pErr != nil {
+		err = pErr
+		return
+	}
+	client = &http.Client{
+		// 设置代理
+		Transport: &http.Transport{
+			Proxy: http.ProxyURL(urlProxy),
+		},
+	}
+	if strings.Index(fileUrl, "http://") < 0 {
+		remoteUrl = fmt.Sprintf("http://%s", fileUrl)
+	}
+	return
+}
+
+//downloadStatusError wraps a non-2xx HTTP response so callers can tell
+//permanent failures (bad credentials, missing object) from transient ones
+type downloadStatusError struct {
+	statusCode int
+	status     string
+}
+
+func (e *downloadStatusError) Error() string {
+	return fmt.Sprintf("download failed with status %s", e.status)
+}
+
+//isPermanentStatusCode reports whether retrying against another domain or
+//after a delay cannot possibly help
+func isPermanentStatusCode(code int) bool {
+	return code == http.StatusUnauthorized || code == http.StatusForbidden || code == http.StatusNotFound
+}
+
+//downloadFile fetches fileName into destDir, failing over across cdnCandidates
+//and retrying with exponential backoff up to maxRetries on transient errors.
+//Permanent errors (401/403/404) and hash mismatches fail fast without retry.
+func downloadFile(ctx context.Context, mac *digest.Mac, destDir, fileName, domainOfBucket string, cdnCandidates []string, downProxy string, fileSize int64, fromBytes int64, verifyHash bool, expectEtag string, bar *pb.ProgressBar, resumeLevelDb *leveldb.DB, ldbWOpt *opt.WriteOptions, maxRetries int, retryBaseDelay time.Duration) (attempts int, err error) {
+	if bar != nil {
+		bar.SetTotal(fileSize)
+		bar.SetCurrent(fromBytes)
+		defer bar.Finish()
+	}
+
 	localFilePath := filepath.Join(destDir, fileName)
 	localFileDir := filepath.Dir(localFilePath)
 	localFilePathTmp := fmt.Sprintf("%s.tmp", localFilePath)
 
-	mkdirErr := os.MkdirAll(localFileDir, 0775)
-	if mkdirErr != nil {
-		err = mkdirErr
+	if mkdirErr := os.MkdirAll(localFileDir, 0775); mkdirErr != nil {
 		logs.Error("MkdirAll failed for", localFileDir, mkdirErr)
-		return
+		return 0, mkdirErr
 	}
 
-	logs.Informational("Downloading", fileName, "=>", localFilePath)
+	if len(cdnCandidates) == 0 {
+		cdnCandidates = []string{""}
+	}
 
-	// http client
-	var client *http.Client
-	remoteUrl := fileUrl
-	downloadProxy := downProxy
-	if downProxy != "" { // 使用代理
-		if strings.Index(downProxy,"http") < 0 {
-			// downloadProxy类似于http://127.0.0.1:8080
-			downloadProxy = fmt.Sprintf("http://%s",downProxy)
+	for attempt := 0; ; attempt++ {
+		attempts = attempt + 1
+		domain := cdnCandidates[attempt%len(cdnCandidates)]
+		fileUrl := makePrivateDownloadLink(mac, domainOfBucket, domain, fileName)
+
+		attemptStart := time.Now()
+		var cpCnt int64
+		cpCnt, err = downloadFileAttempt(ctx, fileUrl, domainOfBucket, downProxy, fileName, localFilePath, localFilePathTmp, fromBytes, verifyHash, expectEtag, bar, resumeLevelDb, ldbWOpt)
+		logs.Informational("Download", fileName, "domain", domain, "attempt", attempts, "elapsed", time.Since(attemptStart), "error", err)
+
+		if err == nil {
+			return attempts, nil
 		}
-		urli := url.URL{}
-		urlProxy,pErr := urli.Parse(downloadProxy)
-		if pErr != nil {
-			err =pErr
-			logs.Informational("Invalid download proxy", downProxy, ", parse error:", pErr)
-			return
+		if err == context.Canceled || err == context.DeadlineExceeded || err == ErrHashMismatch {
+			return attempts, err
 		}
-		client = &http.Client{
-			// 设置代理
-			Transport: &http.Transport{
-				Proxy:http.ProxyURL(urlProxy),
-			},
+		if statusErr, ok := err.(*downloadStatusError); ok && isPermanentStatusCode(statusErr.statusCode) {
+			logs.Error("Download", fileName, "permanent error, giving up", err)
+			return attempts, err
 		}
-		if strings.Index(fileUrl,"http://") < 0 {
-			remoteUrl = fmt.Sprintf("http://%s",fileUrl)
+		if attempt >= maxRetries {
+			logs.Error("Download", fileName, "exhausted retries against", len(cdnCandidates), "domain(s)", err)
+			return attempts, err
 		}
-	} else { // 不使用代理
-		client = &http.Client{}
+
+		//resume from whatever made it to disk in this attempt
+		fromBytes += cpCnt
+
+		backoff := retryBaseDelay * time.Duration(int64(1)<<uint(attempt))
+		sleepFor := backoff + time.Duration(rand.Int63n(int64(backoff)/2+1))
+		logs.Warning("Download", fileName, "retrying in", sleepFor, "after error", err)
+		select {
+		case <-time.After(sleepFor):
+		case <-ctx.Done():
+			return attempts, ctx.Err()
+		}
+	}
+}
+
+//downloadFileAttempt performs a single GET attempt, resuming from fromBytes
+//via a Range request, and returns the number of bytes copied in this attempt
+func downloadFileAttempt(ctx context.Context, fileUrl, domainOfBucket, downProxy, fileName, localFilePath, localFilePathTmp string, fromBytes int64, verifyHash bool, expectEtag string, bar *pb.ProgressBar, resumeLevelDb *leveldb.DB, ldbWOpt *opt.WriteOptions) (cpCnt int64, err error) {
+	startDown := time.Now().Unix()
+
+	logs.Informational("Downloading", fileName, "=>", localFilePath)
+
+	// http client
+	client, remoteUrl, clientErr := newDownloadHttpClient(downProxy, fileUrl)
+	if clientErr != nil {
+		err = clientErr
+		logs.Informational("Invalid download proxy", downProxy, ", parse error:", clientErr)
+		return
 	}
 
 	//new request
@@ -453,14 +721,13 @@ func downloadFile(destDir, fileName, fileUrl, domainsOfBucket,downProxy string,
 		return
 	}
 	//set host
-	req.Host = domainsOfBucket
+	req.Host = domainOfBucket
 
 	if fromBytes != 0 {
 		req.Header.Add("Range", fmt.Sprintf("bytes=%d-", fromBytes))
 	}
 
-
-	resp, respErr := client.Do(req)
+	resp, respErr := client.Do(req.WithContext(ctx))
 
 	if respErr != nil {
 		err = respErr
@@ -483,18 +750,81 @@ func downloadFile(destDir, fileName, fileUrl, domainsOfBucket,downProxy string,
 			return
 		}
 
-		cpCnt, cpErr := io.Copy(localFp, resp.Body)
-		if cpErr != nil {
-			err = cpErr
-			localFp.Close()
-			logs.Error("Download", fileName, "failed", cpErr)
-			return
+		var bodyReader io.Reader = resp.Body
+		if bar != nil {
+			bodyReader = bar.NewProxyReader(bodyReader)
+		}
+		if aggregateBar != nil {
+			//the proxy reader below already counts every byte streamed this
+			//run, across however many retries it takes, exactly once; it
+			//alone keeps Current correct against the Total set from
+			//fileSize-fromBytes, no separate credit for fromBytes needed
+			bodyReader = aggregateBar.NewProxyReader(bodyReader)
+		}
+
+		localAbsFilePath, _ := filepath.Abs(localFilePath)
+		copyBuf := make([]byte, 32*1024)
+	copyLoop:
+		for {
+			select {
+			case <-ctx.Done():
+				localFp.Sync()
+				localFp.Close()
+				resumeLevelDb.Put([]byte(offsetResumeKey(localAbsFilePath)), []byte(strconv.FormatInt(fromBytes+cpCnt, 10)), ldbWOpt)
+				err = ctx.Err()
+				logs.Warning("Download", fileName, "interrupted at offset", fromBytes+cpCnt)
+				return
+			default:
+			}
+
+			n, rErr := bodyReader.Read(copyBuf)
+			if n > 0 {
+				wn, wErr := localFp.Write(copyBuf[:n])
+				cpCnt += int64(wn)
+				if wErr != nil {
+					err = wErr
+					localFp.Close()
+					logs.Error("Download", fileName, "failed", wErr)
+					return
+				}
+			}
+			if rErr == io.EOF {
+				break copyLoop
+			}
+			if rErr != nil {
+				err = rErr
+				localFp.Close()
+				logs.Error("Download", fileName, "failed", rErr)
+				return
+			}
 		}
 		localFp.Close()
 
+		if resp.ContentLength > 0 && cpCnt < resp.ContentLength {
+			err = fmt.Errorf("truncated download: got %d of %d bytes", cpCnt, resp.ContentLength)
+			logs.Warning("Download", fileName, err)
+			return
+		}
+		resumeLevelDb.Delete([]byte(offsetResumeKey(localAbsFilePath)), ldbWOpt)
+
 		endDown := time.Now().Unix()
 		avgSpeed := fmt.Sprintf("%.2fKB/s", float64(cpCnt)/float64(endDown-startDown)/1024)
 
+		if verifyHash {
+			actualEtag, etagErr := calcQetag(localFilePathTmp)
+			if etagErr != nil {
+				err = etagErr
+				logs.Error("Calc etag of", localFilePathTmp, "failed", etagErr)
+				return
+			}
+			if actualEtag != expectEtag {
+				os.Remove(localFilePathTmp)
+				err = ErrHashMismatch
+				logs.Error("Download", fileName, "hash mismatch, expect", expectEtag, "got", actualEtag)
+				return
+			}
+		}
+
 		//move temp file to log file
 		renameErr := os.Rename(localFilePathTmp, localFilePath)
 		if renameErr != nil {
@@ -504,7 +834,7 @@ func downloadFile(destDir, fileName, fileUrl, domainsOfBucket,downProxy string,
 		}
 		logs.Informational("Download", fileName, "=>", localFilePath, "success", avgSpeed)
 	} else {
-		err = errors.New("download failed")
+		err = &downloadStatusError{statusCode: resp.StatusCode, status: resp.Status}
 		logs.Informational("Download", fileName, "failed by url", fileUrl, resp.Status)
 		return
 	}
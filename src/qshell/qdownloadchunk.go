@@ -0,0 +1,346 @@
+package qshell
+
+import (
+	"context"
+	"fmt"
+	"github.com/astaxie/beego/logs"
+	"github.com/cheggaaa/pb/v3"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"qiniu/api.v6/auth/digest"
+	"strings"
+	"sync"
+	"time"
+)
+
+//chunkResumeKey is the leveldb key that marks chunk i of localAbsFilePath as
+//fully written, so an interrupted chunked download only re-requests the
+//chunks it's still missing
+func chunkResumeKey(localAbsFilePath string, chunk int) string {
+	return fmt.Sprintf("%s#chunk%d", localAbsFilePath, chunk)
+}
+
+//isChunkedDownload reports whether fileSize/chunkSize would make
+//downloadFileMaybeChunked choose the chunked path, mirroring its own
+//threshold check
+func isChunkedDownload(fileSize int64, chunksPerFile int, chunkSize int64) bool {
+	return chunksPerFile > 0 && chunkSize > 0 && fileSize > chunkSize
+}
+
+//chunkedDownloadComplete reports whether every chunk of localAbsFilePath has
+//a persisted chunkResumeKey entry. downloadFileChunked truncates the .tmp
+//file to fileSize before a single chunk lands, so matching the final size is
+//not on its own evidence that the download finished; this is the check that
+//actually is
+func chunkedDownloadComplete(resumeLevelDb *leveldb.DB, localAbsFilePath string, fileSize, chunkSize int64) bool {
+	chunkCount := int((fileSize + chunkSize - 1) / chunkSize)
+	for i := 0; i < chunkCount; i++ {
+		if _, err := resumeLevelDb.Get([]byte(chunkResumeKey(localAbsFilePath, i)), nil); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+//supportsByteRanges HEAD-probes fileUrl and reports whether the server
+//advertises `Accept-Ranges: bytes`, the precondition for chunked download
+func supportsByteRanges(ctx context.Context, client *http.Client, fileUrl, domainOfBucket string) bool {
+	req, reqErr := http.NewRequest("HEAD", fileUrl, nil)
+	if reqErr != nil {
+		return false
+	}
+	req.Host = domainOfBucket
+
+	resp, respErr := client.Do(req.WithContext(ctx))
+	if respErr != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	return resp.StatusCode/100 == 2 && strings.EqualFold(resp.Header.Get("Accept-Ranges"), "bytes")
+}
+
+//downloadFileMaybeChunked splits fileName into concurrent byte-range chunks
+//when chunksPerFile/chunkSize are configured and the server supports range
+//requests, falling back to the regular serial downloadFile otherwise
+func downloadFileMaybeChunked(ctx context.Context, mac *digest.Mac, destDir, fileName, domainOfBucket string, cdnCandidates []string, downProxy string, fileSize int64, fromBytes int64, verifyHash bool, expectEtag string, bar *pb.ProgressBar, resumeLevelDb *leveldb.DB, ldbWOpt *opt.WriteOptions, maxRetries int, retryBaseDelay time.Duration, chunksPerFile int, chunkSize int64) (attempts int, err error) {
+	if chunksPerFile <= 0 || chunkSize <= 0 || fileSize <= chunkSize || fromBytes != 0 {
+		return downloadFile(ctx, mac, destDir, fileName, domainOfBucket, cdnCandidates, downProxy, fileSize, fromBytes, verifyHash, expectEtag, bar, resumeLevelDb, ldbWOpt, maxRetries, retryBaseDelay)
+	}
+
+	domain := cdnCandidates[0]
+	fileUrl := makePrivateDownloadLink(mac, domainOfBucket, domain, fileName)
+	client, remoteUrl, clientErr := newDownloadHttpClient(downProxy, fileUrl)
+	if clientErr != nil {
+		return downloadFile(ctx, mac, destDir, fileName, domainOfBucket, cdnCandidates, downProxy, fileSize, fromBytes, verifyHash, expectEtag, bar, resumeLevelDb, ldbWOpt, maxRetries, retryBaseDelay)
+	}
+
+	if !supportsByteRanges(ctx, client, remoteUrl, domainOfBucket) {
+		logs.Informational("Download", fileName, "server does not advertise byte ranges, falling back to serial download")
+		return downloadFile(ctx, mac, destDir, fileName, domainOfBucket, cdnCandidates, downProxy, fileSize, fromBytes, verifyHash, expectEtag, bar, resumeLevelDb, ldbWOpt, maxRetries, retryBaseDelay)
+	}
+
+	return downloadFileChunked(ctx, mac, destDir, fileName, domainOfBucket, cdnCandidates, downProxy, fileSize, verifyHash, expectEtag, bar, resumeLevelDb, ldbWOpt, maxRetries, retryBaseDelay, chunksPerFile, chunkSize)
+}
+
+//downloadFileChunked downloads fileName as ceil(fileSize/chunkSize) concurrent
+//byte-range requests, writing each chunk to its own offset in the shared
+//.tmp file via WriteAt, with at most chunksPerFile chunks in flight.
+func downloadFileChunked(ctx context.Context, mac *digest.Mac, destDir, fileName, domainOfBucket string, cdnCandidates []string, downProxy string, fileSize int64, verifyHash bool, expectEtag string, bar *pb.ProgressBar, resumeLevelDb *leveldb.DB, ldbWOpt *opt.WriteOptions, maxRetries int, retryBaseDelay time.Duration, chunksPerFile int, chunkSize int64) (attempts int, err error) {
+	localFilePath := filepath.Join(destDir, fileName)
+	localFileDir := filepath.Dir(localFilePath)
+	localFilePathTmp := fmt.Sprintf("%s.tmp", localFilePath)
+	localAbsFilePath, _ := filepath.Abs(localFilePath)
+
+	if mkdirErr := os.MkdirAll(localFileDir, 0775); mkdirErr != nil {
+		logs.Error("MkdirAll failed for", localFileDir, mkdirErr)
+		return 0, mkdirErr
+	}
+
+	localFp, openErr := os.OpenFile(localFilePathTmp, os.O_CREATE|os.O_WRONLY, 0655)
+	if openErr != nil {
+		logs.Error("Open local file", localFilePathTmp, "failed", openErr)
+		return 0, openErr
+	}
+	if truncErr := localFp.Truncate(fileSize); truncErr != nil {
+		localFp.Close()
+		logs.Error("Preallocate local file", localFilePathTmp, "failed", truncErr)
+		return 0, truncErr
+	}
+
+	if bar != nil {
+		bar.SetTotal(fileSize)
+		defer bar.Finish()
+	}
+
+	chunkCount := int((fileSize + chunkSize - 1) / chunkSize)
+	var chunkWg sync.WaitGroup
+	sem := make(chan struct{}, chunksPerFile)
+	//firstErrMu also guards maxAttempts: the file-level attempt count
+	//reported to the caller is the worst case across chunks, since chunks
+	//retry independently and there's no single shared attempt counter.
+	//firstErr is a plain error (not atomic.Value) because concurrent chunk
+	//goroutines of the same file can set it to different concrete error
+	//types (a permanent *downloadStatusError from one chunk, a
+	//truncated-read or context error from another), and atomic.Value panics
+	//on a type change between Store calls
+	var firstErrMu sync.Mutex
+	var firstErr error
+	maxAttempts := 1
+
+	for i := 0; i < chunkCount; i++ {
+		start := int64(i) * chunkSize
+		end := start + chunkSize - 1
+		if end >= fileSize {
+			end = fileSize - 1
+		}
+
+		if _, doneErr := resumeLevelDb.Get([]byte(chunkResumeKey(localAbsFilePath, i)), nil); doneErr == nil {
+			//already downloaded in a previous, interrupted run; these bytes
+			//are part of aggregateBar's Total for this file too (the whole
+			//fileSize, since a chunked file's fromBytes is always 0) but will
+			//never pass through downloadChunkAttempt's proxy reader, so credit
+			//them here or the aggregate bar never reaches its Total
+			if bar != nil {
+				bar.Add64(end - start + 1)
+			}
+			if aggregateBar != nil {
+				aggregateBar.Add64(end - start + 1)
+			}
+			continue
+		}
+
+		chunkIdx, chunkStart, chunkEnd := i, start, end
+		chunkWg.Add(1)
+		sem <- struct{}{}
+		//run chunk sub-tasks on their own goroutines rather than the shared
+		//downloadTasks pool: that pool is where the caller of
+		//downloadFileChunked was itself dequeued from, so feeding chunks
+		//back into it would deadlock once every worker is blocked here on
+		//chunkWg.Wait(). sem still caps the in-flight count at chunksPerFile.
+		//Using the file-level bar directly (instead of taking one as a
+		//parameter) also keeps chunk progress on the bar it was SetTotal'd
+		//against, rather than whatever bar a dequeuing worker happens to own.
+		go func() {
+			defer chunkWg.Done()
+			defer func() { <-sem }()
+
+			cAttempts, cErr := downloadChunk(ctx, mac, domainOfBucket, cdnCandidates, downProxy, fileName, localFp, chunkStart, chunkEnd, bar, maxRetries, retryBaseDelay)
+
+			firstErrMu.Lock()
+			if cAttempts > maxAttempts {
+				maxAttempts = cAttempts
+			}
+			if cErr != nil && firstErr == nil {
+				firstErr = cErr
+			}
+			firstErrMu.Unlock()
+
+			if cErr != nil {
+				logs.Error("Download", fileName, "chunk", chunkIdx, fmt.Sprintf("[%d-%d]", chunkStart, chunkEnd), "failed", cErr)
+				return
+			}
+			resumeLevelDb.Put([]byte(chunkResumeKey(localAbsFilePath, chunkIdx)), []byte("done"), ldbWOpt)
+		}()
+	}
+
+	chunkWg.Wait()
+	attempts = maxAttempts
+
+	if firstErr != nil {
+		localFp.Close()
+		return attempts, firstErr
+	}
+
+	if closeErr := localFp.Close(); closeErr != nil {
+		return attempts, closeErr
+	}
+
+	deleteChunkMarkers := func() {
+		for i := 0; i < chunkCount; i++ {
+			resumeLevelDb.Delete([]byte(chunkResumeKey(localAbsFilePath, i)), ldbWOpt)
+		}
+	}
+
+	if verifyHash {
+		actualEtag, etagErr := calcQetag(localFilePathTmp)
+		if etagErr != nil {
+			logs.Error("Calc etag of", localFilePathTmp, "failed", etagErr)
+			return attempts, etagErr
+		}
+		if actualEtag != expectEtag {
+			os.Remove(localFilePathTmp)
+			//the chunk markers only mean anything alongside the .tmp file
+			//they describe; leaving them in leveldb would make the next
+			//run's chunk loop skip every chunk over a freshly truncated,
+			//all-zero .tmp file and fail this same check forever
+			deleteChunkMarkers()
+			logs.Error("Download", fileName, "hash mismatch, expect", expectEtag, "got", actualEtag)
+			return attempts, ErrHashMismatch
+		}
+	}
+
+	deleteChunkMarkers()
+
+	if renameErr := os.Rename(localFilePathTmp, localFilePath); renameErr != nil {
+		logs.Error("Rename temp file to final log file error", renameErr)
+		return attempts, renameErr
+	}
+	logs.Informational("Download", fileName, "=>", localFilePath, "success via", chunkCount, "chunks")
+	return attempts, nil
+}
+
+//downloadChunk fetches the inclusive byte range [start, end] and writes it
+//to localFp at the matching file offset, retrying with backoff across
+//cdnCandidates the same way the serial downloader does. attempts reports how
+//many requests this chunk took, so the caller can roll it up into the
+//file-level attempt count it reports to webhook events.
+func downloadChunk(ctx context.Context, mac *digest.Mac, domainOfBucket string, cdnCandidates []string, downProxy, fileName string, localFp *os.File, start, end int64, bar *pb.ProgressBar, maxRetries int, retryBaseDelay time.Duration) (attempts int, err error) {
+	for attempt := 0; ; attempt++ {
+		attempts = attempt + 1
+		domain := cdnCandidates[attempt%len(cdnCandidates)]
+		fileUrl := makePrivateDownloadLink(mac, domainOfBucket, domain, fileName)
+
+		var copied int64
+		copied, err = downloadChunkAttempt(ctx, fileUrl, domainOfBucket, downProxy, localFp, start, end, bar)
+		if err == nil {
+			return attempts, nil
+		}
+		if err == context.Canceled || err == context.DeadlineExceeded {
+			return attempts, err
+		}
+		if statusErr, ok := err.(*downloadStatusError); ok && isPermanentStatusCode(statusErr.statusCode) {
+			return attempts, err
+		}
+		if attempt >= maxRetries {
+			return attempts, err
+		}
+
+		//resume this chunk from whatever made it to disk in this attempt
+		if start+copied <= end {
+			start += copied
+		}
+
+		backoff := retryBaseDelay * time.Duration(int64(1)<<uint(attempt))
+		sleepFor := backoff + time.Duration(rand.Int63n(int64(backoff)/2+1))
+		select {
+		case <-time.After(sleepFor):
+		case <-ctx.Done():
+			return attempts, ctx.Err()
+		}
+	}
+}
+
+func downloadChunkAttempt(ctx context.Context, fileUrl, domainOfBucket, downProxy string, localFp *os.File, start, end int64, bar *pb.ProgressBar) (copied int64, err error) {
+	client, remoteUrl, clientErr := newDownloadHttpClient(downProxy, fileUrl)
+	if clientErr != nil {
+		err = clientErr
+		return
+	}
+
+	req, reqErr := http.NewRequest("GET", remoteUrl, nil)
+	if reqErr != nil {
+		err = reqErr
+		return
+	}
+	req.Host = domainOfBucket
+	req.Header.Add("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+
+	resp, respErr := client.Do(req.WithContext(ctx))
+	if respErr != nil {
+		err = respErr
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		err = &downloadStatusError{statusCode: resp.StatusCode, status: resp.Status}
+		return
+	}
+
+	var bodyReader io.Reader = resp.Body
+	if bar != nil {
+		bodyReader = bar.NewProxyReader(bodyReader)
+	}
+	if aggregateBar != nil {
+		bodyReader = aggregateBar.NewProxyReader(bodyReader)
+	}
+
+	offset := start
+	copyBuf := make([]byte, 32*1024)
+	for {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
+		default:
+		}
+
+		n, rErr := bodyReader.Read(copyBuf)
+		if n > 0 {
+			wn, wErr := localFp.WriteAt(copyBuf[:n], offset)
+			offset += int64(wn)
+			copied += int64(wn)
+			if wErr != nil {
+				err = wErr
+				return
+			}
+		}
+		if rErr == io.EOF {
+			break
+		}
+		if rErr != nil {
+			err = rErr
+			return
+		}
+	}
+
+	if want := end - start + 1; copied < want {
+		err = fmt.Errorf("truncated chunk download: got %d of %d bytes", copied, want)
+	}
+	return
+}
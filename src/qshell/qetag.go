@@ -0,0 +1,70 @@
+package qshell
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"io"
+	"os"
+)
+
+//block size used by qiniu when chunking files for etag calculation
+const qetagBlockSize = 4 * 1024 * 1024
+
+const (
+	qetagSmallFilePrefix = byte(0x16)
+	qetagLargeFilePrefix = byte(0x96)
+)
+
+//calcQetag computes Qiniu's content hash (the same value returned as `etag`
+//by `ListBucket`) for the local file at filePath.
+//
+//for files <= 4MiB: base64UrlSafe(0x16 + sha1(file))
+//for files  > 4MiB: split into 4MiB blocks, sha1 each block, concatenate the
+//raw digests, sha1 that concatenation, then base64UrlSafe(0x96 + sha1(...))
+func calcQetag(filePath string) (etag string, err error) {
+	fp, openErr := os.Open(filePath)
+	if openErr != nil {
+		err = openErr
+		return
+	}
+	defer fp.Close()
+
+	buf := make([]byte, qetagBlockSize)
+	var blockSha1s []byte
+	blockCount := 0
+
+	for {
+		n, rErr := io.ReadFull(fp, buf)
+		if n > 0 || (rErr == io.EOF && blockCount == 0) {
+			sum := sha1.Sum(buf[:n])
+			blockSha1s = append(blockSha1s, sum[:]...)
+			blockCount++
+		}
+		if rErr == io.EOF {
+			break
+		}
+		if rErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if rErr != nil {
+			err = rErr
+			return
+		}
+	}
+
+	if blockCount <= 1 {
+		etag = encodeQetag(qetagSmallFilePrefix, blockSha1s)
+		return
+	}
+
+	sum := sha1.Sum(blockSha1s)
+	etag = encodeQetag(qetagLargeFilePrefix, sum[:])
+	return
+}
+
+func encodeQetag(prefix byte, sum []byte) string {
+	buf := make([]byte, 0, len(sum)+1)
+	buf = append(buf, prefix)
+	buf = append(buf, sum...)
+	return base64.URLEncoding.EncodeToString(buf)
+}
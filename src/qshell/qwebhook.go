@@ -0,0 +1,150 @@
+package qshell
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/astaxie/beego/logs"
+	"net/http"
+	"time"
+)
+
+const (
+	webhookQueueSize   = 256
+	webhookMaxRetries  = 3
+	webhookRetryDelay  = time.Second
+	webhookHttpTimeout = 10 * time.Second
+)
+
+//WebhookConfig configures real-time HTTP notifications of download job
+//lifecycle events, for integration with monitoring/alerting pipelines
+type WebhookConfig struct {
+	URL       string   `json:"url,omitempty"`
+	AuthToken string   `json:"auth_token,omitempty"`
+	Events    []string `json:"events,omitempty"`
+}
+
+type webhookEvent struct {
+	Event     string      `json:"event"`
+	Timestamp int64       `json:"timestamp"`
+	Data      interface{} `json:"data"`
+}
+
+//webhookNotifier delivers lifecycle events to WebhookConfig.URL off the
+//download hot path: notify() never blocks the caller, deliveries happen on
+//a dedicated goroutine, and a full queue drops the oldest pending event
+//rather than stalling downloads
+type webhookNotifier struct {
+	cfg    WebhookConfig
+	events map[string]bool
+	queue  chan webhookEvent
+	client *http.Client
+	done   chan struct{}
+}
+
+//newWebhookNotifier returns nil when cfg.URL is empty, so callers can use
+//the zero value without a nil check on every notify() call
+func newWebhookNotifier(cfg WebhookConfig) *webhookNotifier {
+	if cfg.URL == "" {
+		return nil
+	}
+
+	events := make(map[string]bool, len(cfg.Events))
+	for _, e := range cfg.Events {
+		events[e] = true
+	}
+
+	n := &webhookNotifier{
+		cfg:    cfg,
+		events: events,
+		queue:  make(chan webhookEvent, webhookQueueSize),
+		client: &http.Client{Timeout: webhookHttpTimeout},
+		done:   make(chan struct{}),
+	}
+	go n.run()
+	return n
+}
+
+func (n *webhookNotifier) enabled(event string) bool {
+	if len(n.events) == 0 {
+		return true
+	}
+	return n.events[event]
+}
+
+func (n *webhookNotifier) notify(event string, data interface{}) {
+	if n == nil || !n.enabled(event) {
+		return
+	}
+
+	evt := webhookEvent{Event: event, Timestamp: time.Now().Unix(), Data: data}
+	select {
+	case n.queue <- evt:
+		return
+	default:
+	}
+
+	//queue full, drop the oldest pending event and make room for this one
+	select {
+	case <-n.queue:
+	default:
+	}
+	select {
+	case n.queue <- evt:
+	default:
+		logs.Warning("Webhook queue full, dropped event", event)
+	}
+}
+
+func (n *webhookNotifier) run() {
+	for evt := range n.queue {
+		n.deliver(evt)
+	}
+	close(n.done)
+}
+
+func (n *webhookNotifier) deliver(evt webhookEvent) {
+	body, mErr := json.Marshal(evt)
+	if mErr != nil {
+		logs.Error("Marshal webhook event", evt.Event, "error", mErr)
+		return
+	}
+
+	for attempt := 0; attempt <= webhookMaxRetries; attempt++ {
+		req, reqErr := http.NewRequest("POST", n.cfg.URL, bytes.NewReader(body))
+		if reqErr != nil {
+			logs.Error("New webhook request error", reqErr)
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if n.cfg.AuthToken != "" {
+			req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", n.cfg.AuthToken))
+		}
+
+		resp, doErr := n.client.Do(req)
+		if doErr == nil {
+			resp.Body.Close()
+			if resp.StatusCode/100 == 2 {
+				return
+			}
+			logs.Warning("Webhook delivery", evt.Event, "attempt", attempt+1, "status", resp.Status)
+		} else {
+			logs.Warning("Webhook delivery", evt.Event, "attempt", attempt+1, "error", doErr)
+		}
+
+		if attempt < webhookMaxRetries {
+			time.Sleep(webhookRetryDelay * time.Duration(attempt+1))
+		}
+	}
+	logs.Error("Webhook delivery", evt.Event, "failed after", webhookMaxRetries+1, "attempts")
+}
+
+//close drains the notifier, blocking until every queued event has either
+//been delivered or exhausted its retries
+func (n *webhookNotifier) close() {
+	if n == nil {
+		return
+	}
+	close(n.queue)
+	<-n.done
+}